@@ -0,0 +1,63 @@
+package autocert
+
+import "time"
+
+// RetryBackoff controls how domainRenewal and ocspUpdater reschedule a
+// failed attempt. The delay grows exponentially with the number of
+// consecutive failures, up to Cap, with a random jitter added on top so
+// that many domains failing at once don't all retry in lockstep.
+type RetryBackoff struct {
+	// Base is the unit the delay grows from: after n consecutive failures
+	// the delay before jitter is Base*2^n (2*Base after the first). Zero
+	// means defaultRetryBase.
+	Base time.Duration
+	// Cap is the maximum delay, reached regardless of how many further
+	// failures occur. Zero means the caller's own default cap.
+	Cap time.Duration
+	// MaxAttempts limits how many consecutive failures count toward the
+	// exponent: beyond it the delay stays at Base*2^MaxAttempts (or Cap,
+	// if that is smaller). The callers' failCount itself keeps counting.
+	// Zero means no explicit limit (the delay is still capped by Cap).
+	MaxAttempts int
+}
+
+const defaultRetryBase = time.Minute
+
+// next computes the backoff for the given number of consecutive failures
+// (failCount >= 1) against the provided default base/cap, applying a
+// uniform random jitter of up to the computed delay's own magnitude.
+func (b *RetryBackoff) next(failCount int, defaultCap time.Duration) time.Duration {
+	base := defaultRetryBase
+	limit := defaultCap
+	maxAttempts := 0
+	if b != nil {
+		if b.Base > 0 {
+			base = b.Base
+		}
+		if b.Cap > 0 {
+			limit = b.Cap
+		}
+		maxAttempts = b.MaxAttempts
+	}
+	if maxAttempts > 0 && failCount > maxAttempts {
+		failCount = maxAttempts
+	}
+	d := base
+	for i := 0; i < failCount && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if d <= 0 {
+		return 0
+	}
+	d += time.Duration(pseudoRand.int63n(int64(d)))
+	if d > limit {
+		// Re-clamp: jitter is up to d's own magnitude, so without this a
+		// delay already at limit could be pushed to nearly 2x limit,
+		// which would break the "Cap is the maximum delay" contract.
+		d = limit
+	}
+	return d
+}
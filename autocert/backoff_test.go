@@ -0,0 +1,74 @@
+package autocert
+
+import (
+	"testing"
+	"time"
+)
+
+// backoffBase recomputes next()'s delay before the random jitter is added
+// (ignoring MaxAttempts) so the exponential part of the formula can be
+// checked exactly.
+func backoffBase(b *RetryBackoff, failCount int, defaultCap time.Duration) time.Duration {
+	base := defaultRetryBase
+	limit := defaultCap
+	if b != nil {
+		if b.Base > 0 {
+			base = b.Base
+		}
+		if b.Cap > 0 {
+			limit = b.Cap
+		}
+	}
+	d := base
+	for i := 0; i < failCount && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+func TestRetryBackoffDoubling(t *testing.T) {
+	b := &RetryBackoff{Base: time.Minute, Cap: time.Hour}
+	cases := []struct {
+		failCount int
+		want      time.Duration
+	}{
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{3, 8 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := backoffBase(b, c.failCount, time.Hour); got != c.want {
+			t.Errorf("backoff at failCount=%d = %v, want %v", c.failCount, got, c.want)
+		}
+	}
+}
+
+func TestRetryBackoffCap(t *testing.T) {
+	b := &RetryBackoff{Base: time.Minute, Cap: 10 * time.Minute}
+	if got := backoffBase(b, 10, 10*time.Minute); got != 10*time.Minute {
+		t.Errorf("backoff at failCount=10 = %v, want cap %v", got, 10*time.Minute)
+	}
+}
+
+func TestRetryBackoffJitterWithinBounds(t *testing.T) {
+	b := &RetryBackoff{Base: time.Minute, Cap: time.Hour}
+	base := backoffBase(b, 2, time.Hour)
+	for i := 0; i < 20; i++ {
+		d := b.next(2, time.Hour)
+		if d < base || d > 2*base {
+			t.Fatalf("next(2) = %v, want in [%v, %v]", d, base, 2*base)
+		}
+	}
+}
+
+func TestRetryBackoffJitterNeverExceedsCap(t *testing.T) {
+	b := &RetryBackoff{Base: time.Minute, Cap: 10 * time.Minute}
+	for i := 0; i < 20; i++ {
+		if d := b.next(10, 10*time.Minute); d > 10*time.Minute {
+			t.Fatalf("next(10) = %v, want <= cap %v", d, 10*time.Minute)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package autocert
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// GetCertificate implements the tls.Config.GetCertificate hook. It serves
+// an ECDSA certificate to clients that advertise ECDSA support over an
+// ECDHE cipher suite, and RSA to everyone else, fanning out a
+// domainRenewal per (domain, key type) the first time either is needed.
+// An ECDSA-preferring client may be served RSA instead if no ECDSA cert
+// is cached yet; the reverse fallback is never attempted since it would
+// serve a cert type the client already told us it can't handle.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain := hello.ServerName
+	if domain == "" {
+		return nil, fmt.Errorf("autocert: missing server name")
+	}
+
+	ck := preferredCertKey(domain, hello)
+	servedCK := ck
+	state, ok := m.certState(ck)
+	if !ok {
+		if fbCK, safe := fallbackCertKey(ck); safe {
+			// No ECDSA cert yet, but this client can parse RSA: rather
+			// than blocking the handshake on a fresh ACME order, fall
+			// back to whatever RSA cert we already have. The reverse
+			// (serving ECDSA to an RSA-only ck) is never safe: ck is
+			// only RSA because supportsECDSA already said the client
+			// can't handle ECDSA.
+			if fbState, fbOK := m.certState(fbCK); fbOK {
+				state, ok, servedCK = fbState, true, fbCK
+			}
+		}
+	}
+	if !ok {
+		m.startRenewal(certKey{domain: domain}, nil)
+		m.startRenewal(certKey{domain: domain, isRSA: true}, nil)
+		return nil, fmt.Errorf("autocert: certificate for %q is not yet available", domain)
+	}
+
+	tlscert, err := state.tlscert()
+	if err != nil {
+		return nil, err
+	}
+
+	ocspDER, ocspNextUpdate := m.ocspStaple(servedCK)
+	if err := checkOCSPRequired(state.leaf, ocspDER, ocspNextUpdate); err != nil {
+		// Must-Staple and no usable staple: better to refuse outright
+		// than hand clients a chain most of them will reject anyway.
+		return nil, err
+	}
+	tlscert.OCSPStaple = ocspDER
+	return tlscert, nil
+}
+
+// ocspStaple returns the current cached OCSP staple for ck, if any.
+func (m *Manager) ocspStaple(ck certKey) (der []byte, nextUpdate time.Time) {
+	state, ok := m.ocspStates[ck]
+	if !ok {
+		return nil, time.Time{}
+	}
+	state.Lock()
+	defer state.Unlock()
+	return state.ocspDER, state.nextUpdate
+}
+
+// certState returns the cached certState for ck, if any.
+func (m *Manager) certState(ck certKey) (*certState, bool) {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	state, ok := m.state[ck]
+	return state, ok
+}
+
+// startRenewal starts a domainRenewal for ck if one isn't already
+// running, using key as its initial private key (a fresh one of the
+// right algorithm is generated if key is nil).
+func (m *Manager) startRenewal(ck certKey, key crypto.Signer) {
+	m.renewalMu.Lock()
+	defer m.renewalMu.Unlock()
+	if m.renewal == nil {
+		m.renewal = make(map[certKey]*domainRenewal)
+	}
+	if _, ok := m.renewal[ck]; ok {
+		return
+	}
+	if key == nil {
+		var err error
+		key, err = newSignerLike(ck, nil)
+		if err != nil {
+			m.logf("autocert: failed to generate initial key for %s: %v", ck.domain, err)
+			return
+		}
+	}
+	dr := &domainRenewal{m: m, ck: ck, key: key}
+	m.renewal[ck] = dr
+	// exp is set to now so dr.next comes out negative (clamped to 0) and
+	// the first renewal attempt fires right away.
+	dr.start(timeNow())
+}
@@ -0,0 +1,19 @@
+package autocert
+
+import "testing"
+
+func TestFallbackCertKey(t *testing.T) {
+	ecdsaCK := certKey{domain: "example.com"}
+	fb, ok := fallbackCertKey(ecdsaCK)
+	if !ok {
+		t.Fatal("fallbackCertKey(ECDSA) ok = false, want true")
+	}
+	if !fb.isRSA || fb.domain != "example.com" {
+		t.Errorf("fallbackCertKey(ECDSA) = %+v, want RSA certKey for the same domain", fb)
+	}
+
+	rsaCK := certKey{domain: "example.com", isRSA: true}
+	if _, ok := fallbackCertKey(rsaCK); ok {
+		t.Error("fallbackCertKey(RSA) ok = true, want false: RSA must never fall back to ECDSA")
+	}
+}
@@ -0,0 +1,84 @@
+package autocert
+
+import "crypto/tls"
+
+// certKey identifies a certificate stored either in Manager.state or in
+// a Cache. A single domain may have more than one certKey: one per
+// supported key algorithm, so that the server can present an ECDSA
+// certificate to modern clients and fall back to RSA for legacy ones.
+type certKey struct {
+	domain string
+	isRSA  bool // true for RSA-2048 certs, false for ECDSA (P-256) certs
+}
+
+// cacheKey returns the Cache key under which this certKey's certificate
+// and private key are stored. RSA entries get a "+rsa" suffix so they
+// don't collide with the ECDSA entry (or with caches populated before
+// dual-key support existed).
+func (c certKey) cacheKey() string {
+	if c.isRSA {
+		return c.domain + "+rsa"
+	}
+	return c.domain
+}
+
+// preferredCertKey returns the certKey GetCertificate should look up for
+// the given ClientHello: ECDSA when the client advertises both an ECDSA
+// signature algorithm and an ECDHE cipher suite, RSA otherwise.
+func preferredCertKey(domain string, hello *tls.ClientHelloInfo) certKey {
+	if supportsECDSA(hello) {
+		return certKey{domain: domain}
+	}
+	return certKey{domain: domain, isRSA: true}
+}
+
+// fallbackCertKey returns the certKey GetCertificate should try if ck
+// isn't cached yet, and whether a fallback is safe at all. Falling back
+// is only safe from ECDSA to RSA: an RSA ck means supportsECDSA already
+// determined the client doesn't support ECDSA, so serving it an ECDSA
+// cert would break the handshake. An ECDSA-preferring client, by
+// contrast, can always parse an RSA cert, so it may fall back to one.
+func fallbackCertKey(ck certKey) (certKey, bool) {
+	if ck.isRSA {
+		return certKey{}, false
+	}
+	return certKey{domain: ck.domain, isRSA: true}, true
+}
+
+// supportsECDSA reports whether hello indicates the client is willing to
+// negotiate an ECDSA certificate over an ECDHE cipher suite.
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	if hello == nil {
+		return false
+	}
+	ecdsaOK := false
+	for _, sa := range hello.SignatureSchemes {
+		switch sa {
+		case tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+			ecdsaOK = true
+		}
+		if ecdsaOK {
+			break
+		}
+	}
+	if !ecdsaOK {
+		// Pre-TLS1.2 clients don't send signature_algorithms; assume they
+		// can do ECDSA if they offer an ECDHE-ECDSA suite at all.
+		ecdsaOK = len(hello.SignatureSchemes) == 0
+	}
+	if !ecdsaOK {
+		return false
+	}
+	for _, cs := range hello.CipherSuites {
+		switch cs {
+		case tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package autocert
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestPreferredCertKey(t *testing.T) {
+	modern := &tls.ClientHelloInfo{
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	if ck := preferredCertKey("example.com", modern); ck.isRSA {
+		t.Errorf("preferredCertKey(modern) = %+v, want ECDSA", ck)
+	}
+
+	legacy := &tls.ClientHelloInfo{
+		SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256},
+		CipherSuites:     []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	}
+	if ck := preferredCertKey("example.com", legacy); !ck.isRSA {
+		t.Errorf("preferredCertKey(legacy) = %+v, want RSA", ck)
+	}
+}
+
+func TestCertKeyCacheKey(t *testing.T) {
+	ecdsa := certKey{domain: "example.com"}
+	rsa := certKey{domain: "example.com", isRSA: true}
+	if ecdsa.cacheKey() == rsa.cacheKey() {
+		t.Errorf("ECDSA and RSA certKeys must not share a cache key, got %q for both", ecdsa.cacheKey())
+	}
+	if ecdsa.cacheKey() != "example.com" {
+		t.Errorf("ecdsa.cacheKey() = %q, want %q", ecdsa.cacheKey(), "example.com")
+	}
+}
@@ -0,0 +1,102 @@
+package autocert
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLockHeld is returned by RenewalLocker.Acquire when another instance
+// currently holds the lock for key.
+var ErrLockHeld = errors.New("autocert: renewal lock is held by another instance")
+
+// RenewalLocker coordinates renewal and OCSP-refresh work across a
+// cluster of Manager instances so that only one of them talks to the
+// ACME CA or OCSP responder for a given domain at a time. Implementations
+// must be safe for concurrent use.
+//
+// Acquire returns a fencing token identifying this holder's lease; callers
+// should pass it back to Release so a lease that has already expired (and
+// been re-acquired by someone else) can't be released out from under its
+// new holder.
+type RenewalLocker interface {
+	Acquire(ctx context.Context, key string, ttl time.Duration) (fencingToken string, err error)
+	Release(ctx context.Context, key string, fencingToken string) error
+}
+
+// renewalLocker returns m.RenewalLocker, falling back to a no-op locker
+// for single-node operation when none was configured.
+func (m *Manager) renewalLocker() RenewalLocker {
+	if m.RenewalLocker == nil {
+		return noopLocker{}
+	}
+	return m.RenewalLocker
+}
+
+// noopLocker is the default RenewalLocker for single-node operation: it
+// grants every lock request immediately and never contends.
+type noopLocker struct{}
+
+func (noopLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+func (noopLocker) Release(ctx context.Context, key string, fencingToken string) error {
+	return nil
+}
+
+// releaseScript is a Lua script that only deletes the key if it still holds the
+// fencing token we were given on Acquire, so a lease we've already lost
+// (e.g. because it expired and another node acquired it) isn't torn down
+// from under its new holder.
+const releaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// RedisLocker is a RenewalLocker backed by Redis, implemented with
+// SET key token NX PX ttl and a fencing-token-checked release.
+type RedisLocker struct {
+	// KeyPrefix is prepended to every lock key, e.g. "autocert:lock:".
+	KeyPrefix string
+
+	client *redis.Client
+}
+
+// NewRedisLocker returns a RedisLocker using client for storage.
+func NewRedisLocker(client *redis.Client, keyPrefix string) *RedisLocker {
+	return &RedisLocker{KeyPrefix: keyPrefix, client: client}
+}
+
+func (l *RedisLocker) Acquire(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token, err := newFencingToken()
+	if err != nil {
+		return "", err
+	}
+	ok, err := l.client.SetNX(ctx, l.KeyPrefix+key, token, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrLockHeld
+	}
+	return token, nil
+}
+
+func (l *RedisLocker) Release(ctx context.Context, key string, fencingToken string) error {
+	return l.client.Eval(ctx, releaseScript, []string{l.KeyPrefix + key}, fencingToken).Err()
+}
+
+func newFencingToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
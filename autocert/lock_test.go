@@ -0,0 +1,103 @@
+package autocert
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNoopLockerAlwaysAcquires(t *testing.T) {
+	var l noopLocker
+	ctx := context.Background()
+	token, err := l.Acquire(ctx, "example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := l.Release(ctx, "example.com", token); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+func TestNewFencingTokenUnique(t *testing.T) {
+	a, err := newFencingToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newFencingToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("newFencingToken produced the same token twice: %q", a)
+	}
+	if len(a) == 0 {
+		t.Error("newFencingToken returned an empty token")
+	}
+}
+
+func TestLockRetryDelayWithinBounds(t *testing.T) {
+	ttl := time.Minute
+	for i := 0; i < 20; i++ {
+		d := lockRetryDelay(ttl)
+		if d < ttl || d > 2*ttl {
+			t.Fatalf("lockRetryDelay(%v) = %v, want in [%v, %v]", ttl, d, ttl, 2*ttl)
+		}
+	}
+}
+
+// newTestRedisLocker returns a RedisLocker backed by an in-process fake
+// Redis server, and a func to shut that server down.
+func newTestRedisLocker(t *testing.T) (*RedisLocker, func()) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run: %v", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return NewRedisLocker(client, "test:"), mr.Close
+}
+
+func TestRedisLockerAcquireContendsUntilReleased(t *testing.T) {
+	locker, closeFn := newTestRedisLocker(t)
+	defer closeFn()
+	ctx := context.Background()
+
+	token, err := locker.Acquire(ctx, "example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := locker.Acquire(ctx, "example.com", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("second Acquire = %v, want ErrLockHeld", err)
+	}
+
+	if err := locker.Release(ctx, "example.com", token); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := locker.Acquire(ctx, "example.com", time.Minute); err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+}
+
+func TestRedisLockerReleaseRequiresMatchingFencingToken(t *testing.T) {
+	locker, closeFn := newTestRedisLocker(t)
+	defer closeFn()
+	ctx := context.Background()
+
+	if _, err := locker.Acquire(ctx, "example.com", time.Minute); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// A stale holder (one whose lease already expired and was
+	// re-acquired by someone else) must not be able to tear down the new
+	// holder's lease by releasing with its old, mismatched token.
+	if err := locker.Release(ctx, "example.com", "stale-token"); err != nil {
+		t.Fatalf("Release with mismatched token returned an error: %v", err)
+	}
+	if _, err := locker.Acquire(ctx, "example.com", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("lock was released by a mismatched fencing token; Acquire = %v, want ErrLockHeld", err)
+	}
+}
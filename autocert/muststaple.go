@@ -0,0 +1,54 @@
+package autocert
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"time"
+)
+
+// oidExtensionTLSFeature is the id-pe-tlsfeature extension (RFC 7633),
+// commonly used to signal OCSP Must-Staple when it asserts status_request.
+var oidExtensionTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// tlsFeatureStatusRequest is the TLSFeature value (RFC 6066's
+// status_request) that marks a certificate Must-Staple.
+const tlsFeatureStatusRequest = 5
+
+// ErrMustStapleNoStaple is returned when a Must-Staple certificate has no
+// usable (non-empty, unexpired) OCSP staple to present.
+var ErrMustStapleNoStaple = errors.New("autocert: certificate requires a stapled OCSP response but none is available")
+
+// isMustStaple reports whether leaf asserts the id-pe-tlsfeature
+// extension with status_request, i.e. it requires OCSP stapling.
+func isMustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidExtensionTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, f := range features {
+			if f == tlsFeatureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOCSPRequired is called from GetCertificate before a certificate is
+// handed to a client. If leaf is Must-Staple, it refuses to serve the
+// cert when there's no valid staple, rather than presenting a chain many
+// clients will reject outright.
+func checkOCSPRequired(leaf *x509.Certificate, ocspDER []byte, ocspNextUpdate time.Time) error {
+	if !isMustStaple(leaf) {
+		return nil
+	}
+	if len(ocspDER) == 0 || (!ocspNextUpdate.IsZero() && ocspNextUpdate.Before(timeNow())) {
+		return ErrMustStapleNoStaple
+	}
+	return nil
+}
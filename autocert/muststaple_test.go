@@ -0,0 +1,49 @@
+package autocert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+	"time"
+)
+
+func mustStapleLeaf(t *testing.T) *x509.Certificate {
+	t.Helper()
+	value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509.Certificate{
+		Extensions: []pkix.Extension{
+			{Id: oidExtensionTLSFeature, Value: value},
+		},
+	}
+}
+
+func TestIsMustStaple(t *testing.T) {
+	if isMustStaple(&x509.Certificate{}) {
+		t.Error("isMustStaple(no extension) = true, want false")
+	}
+	if !isMustStaple(mustStapleLeaf(t)) {
+		t.Error("isMustStaple(status_request extension) = false, want true")
+	}
+}
+
+func TestCheckOCSPRequired(t *testing.T) {
+	plain := &x509.Certificate{}
+	if err := checkOCSPRequired(plain, nil, time.Time{}); err != nil {
+		t.Errorf("non-Must-Staple cert with no staple: got %v, want nil", err)
+	}
+
+	leaf := mustStapleLeaf(t)
+	if err := checkOCSPRequired(leaf, nil, time.Time{}); err != ErrMustStapleNoStaple {
+		t.Errorf("Must-Staple cert with no staple: got %v, want %v", err, ErrMustStapleNoStaple)
+	}
+	if err := checkOCSPRequired(leaf, []byte("der"), time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("Must-Staple cert with a fresh staple: got %v, want nil", err)
+	}
+	if err := checkOCSPRequired(leaf, []byte("der"), time.Now().Add(-time.Hour)); err != ErrMustStapleNoStaple {
+		t.Errorf("Must-Staple cert with an expired staple: got %v, want %v", err, ErrMustStapleNoStaple)
+	}
+}
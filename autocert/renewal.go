@@ -7,6 +7,11 @@ package autocert
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
 	"sync"
 	"time"
 )
@@ -14,15 +19,32 @@ import (
 // renewJitter is the maximum deviation from Manager.RenewBefore.
 const renewJitter = time.Hour
 
+// defaultKeyRotationInterval is used when Manager.KeyRotationInterval is zero.
+const defaultKeyRotationInterval = 180 * 24 * time.Hour
+
 // domainRenewal tracks the state used by the periodic timers
-// renewing a single domain's cert.
+// renewing a single (domain, key type) cert.
 type domainRenewal struct {
-	m      *Manager
-	domain string
-	key    crypto.Signer
+	m   *Manager
+	ck  certKey
+	key crypto.Signer
+
+	timerMu   sync.Mutex
+	timer     *time.Timer
+	failCount int
+}
+
+// defaultRenewalBackoffCap is used when Manager.RetryBackoff.Cap is zero.
+const defaultRenewalBackoffCap = 24 * time.Hour
+
+// renewLockTTL is the lease duration requested for the renewal lock.
+const renewLockTTL = 10 * time.Minute
 
-	timerMu sync.Mutex
-	timer   *time.Timer
+// lockRetryDelay returns the delay before retrying a lock Acquire that
+// found the lease already held elsewhere: roughly ttl, jittered, so
+// contending nodes don't all retry in lockstep.
+func lockRetryDelay(ttl time.Duration) time.Duration {
+	return ttl + time.Duration(pseudoRand.int63n(int64(ttl)))
 }
 
 // start starts a cert renewal timer at the time
@@ -61,11 +83,12 @@ func (dr *domainRenewal) renew() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
-	// TODO: rotate dr.key at some point?
 	next, err := dr.do(ctx)
 	if err != nil {
-		next = renewJitter / 2
-		next += time.Duration(pseudoRand.int63n(int64(next)))
+		dr.failCount++
+		next = dr.m.RetryBackoff.next(dr.failCount, defaultRenewalBackoffCap)
+	} else {
+		dr.failCount = 0
 	}
 	dr.timer = time.AfterFunc(next, dr.renew)
 	testDidRenewLoop(next, err)
@@ -80,36 +103,131 @@ func (dr *domainRenewal) renew() {
 //
 // The returned value is a time interval after which the renewal should occur again.
 func (dr *domainRenewal) do(ctx context.Context) (time.Duration, error) {
-	// a race is likely unavoidable in a distributed environment
-	// but we try nonetheless
-	if tlscert, err := dr.m.cacheGet(ctx, dr.domain); err == nil {
+	// In a distributed deployment only one instance should actually talk
+	// to the ACME CA for a given domain; the rest pick the refreshed cert
+	// up from the shared Cache on their next tick via cacheGet below.
+	locker := dr.m.renewalLocker()
+	token, err := locker.Acquire(ctx, "renew:"+dr.ck.cacheKey(), renewLockTTL)
+	if err != nil {
+		if errors.Is(err, ErrLockHeld) {
+			// Not holding the lease is the expected, common case on every
+			// non-leader node. Back off by roughly the lease TTL rather
+			// than looping on Acquire: routing this through dr.next(),
+			// which expects an actual cert-expiry time, would synthesize
+			// a near-future "expiry" and come back deeply negative
+			// (clamped to 0), causing a tight retry loop instead of a
+			// backoff.
+			return lockRetryDelay(renewLockTTL), nil
+		}
+		// The locker backend itself is unhealthy (e.g. Redis
+		// unreachable): surface it rather than silently behaving like a
+		// healthy single-node deployment, and let it count toward
+		// failCount so RetryBackoff kicks in.
+		dr.m.logf("autocert: acquiring renewal lock for %s failed: %v", dr.ck.domain, err)
+		return 0, err
+	}
+	defer locker.Release(ctx, "renew:"+dr.ck.cacheKey(), token)
+
+	if tlscert, err := dr.m.cacheGet(ctx, dr.ck.cacheKey()); err == nil {
 		next := dr.next(tlscert.Leaf.NotAfter)
 		if next > dr.m.renewBefore()+renewJitter {
 			return next, nil
 		}
 	}
 
-	der, leaf, err := dr.m.authorizedCert(ctx, dr.key, dr.domain)
+	key := dr.key
+	rotated := false
+	if dr.keyNeedsRotation() {
+		newKey, err := newSignerLike(dr.ck, key)
+		if err == nil {
+			key = newKey
+			rotated = true
+		} else {
+			// A failed rotation shouldn't block renewal; keep the old key
+			// and try rotating again next time around.
+			dr.m.logf("autocert: key rotation for %s failed, keeping current key: %v", dr.ck.domain, err)
+		}
+	}
+
+	der, leaf, err := dr.m.authorizedCert(ctx, key, dr.ck.domain)
 	if err != nil {
 		return 0, err
 	}
+	// Only stamp a fresh keyCreatedAt when the key actually rotated this
+	// cycle; otherwise carry the old one forward. do() reissues the cert
+	// on every renewal (far more often than KeyRotationInterval), so
+	// resetting this unconditionally would mean keyNeedsRotation never
+	// sees an age older than one renewal interval.
+	keyCreatedAt := timeNow()
+	if !rotated {
+		if prev, ok := dr.m.certState(dr.ck); ok && !prev.keyCreatedAt.IsZero() {
+			keyCreatedAt = prev.keyCreatedAt
+		}
+	}
 	state := &certState{
-		key:  dr.key,
-		cert: der,
-		leaf: leaf,
+		key:          key,
+		cert:         der,
+		leaf:         leaf,
+		keyCreatedAt: keyCreatedAt,
 	}
 	tlscert, err := state.tlscert()
 	if err != nil {
 		return 0, err
 	}
-	dr.m.cachePut(ctx, dr.domain, tlscert)
+	if err := dr.m.cachePut(ctx, dr.ck.cacheKey(), tlscert); err != nil {
+		// Don't adopt the new key/state until the cert is durably cached:
+		// if we crash right after this, the old key must still be able to
+		// serve the old (still cached) cert on restart.
+		return 0, err
+	}
 	dr.m.stateMu.Lock()
 	defer dr.m.stateMu.Unlock()
+	if key != dr.key {
+		dr.m.logf("autocert: rotated private key for %s", dr.ck.domain)
+		// OnKeyRotated is optional; it lets callers feed key rotation
+		// into their own metrics without this package taking a
+		// dependency on a particular metrics library.
+		if dr.m.OnKeyRotated != nil {
+			dr.m.OnKeyRotated(dr.ck)
+		}
+		dr.key = key
+	}
 	// m.state is guaranteed to be non-nil at this point
-	dr.m.state[dr.domain] = state
+	dr.m.state[dr.ck] = state
 	return dr.next(leaf.NotAfter), nil
 }
 
+// keyNeedsRotation reports whether dr.key has been in use for longer than
+// the configured KeyRotationInterval and should be replaced on the next
+// successful renewal.
+func (dr *domainRenewal) keyNeedsRotation() bool {
+	dr.m.stateMu.RLock()
+	state, ok := dr.m.state[dr.ck]
+	dr.m.stateMu.RUnlock()
+	if !ok || state.keyCreatedAt.IsZero() {
+		return false
+	}
+	interval := dr.m.KeyRotationInterval
+	if interval <= 0 {
+		interval = defaultKeyRotationInterval
+	}
+	return timeNow().Sub(state.keyCreatedAt) > interval
+}
+
+// newSignerLike generates a fresh crypto.Signer for ck's key type: ECDSA
+// P-256, or RSA with the same key size as cur (2048 bits when cur is not
+// an RSA key, e.g. nil).
+func newSignerLike(ck certKey, cur crypto.Signer) (crypto.Signer, error) {
+	if ck.isRSA {
+		bits := 2048
+		if k, ok := cur.(*rsa.PrivateKey); ok {
+			bits = k.Size() * 8
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
 func (dr *domainRenewal) next(expiry time.Time) time.Duration {
 	d := expiry.Sub(timeNow()) - dr.m.renewBefore()
 	// add a bit of randomness to renew deadline
@@ -124,20 +242,27 @@ func (dr *domainRenewal) next(expiry time.Time) time.Duration {
 var testDidRenewLoop = func(next time.Duration, err error) {}
 
 type ocspUpdater struct {
-	m      *Manager
-	domain string
+	m  *Manager
+	ck certKey
 
-	timerMu sync.Mutex
-	timer   *time.Timer
+	timerMu   sync.Mutex
+	timer     *time.Timer
+	failCount int
 }
 
-func (ou *ocspUpdater) start(next time.Time) {
+// defaultOCSPBackoffCap is used when Manager.RetryBackoff.Cap is zero.
+const defaultOCSPBackoffCap = 6 * time.Hour
+
+// ocspLockTTL is the lease duration requested for the OCSP refresh lock.
+const ocspLockTTL = 5 * time.Minute
+
+func (ou *ocspUpdater) start(thisUpdate, nextUpdate time.Time) {
 	ou.timerMu.Lock()
 	defer ou.timerMu.Unlock()
 	if ou.timer != nil {
 		return
 	}
-	ou.timer = time.AfterFunc(ou.next(next), ou.update)
+	ou.timer = time.AfterFunc(ou.next(thisUpdate, nextUpdate), ou.update)
 }
 
 func (ou *ocspUpdater) stop() {
@@ -159,28 +284,67 @@ func (ou *ocspUpdater) update() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
+
+	locker := ou.m.renewalLocker()
+	token, err := locker.Acquire(ctx, "ocsp:"+ou.ck.cacheKey(), ocspLockTTL)
+	if err != nil {
+		var next time.Duration
+		if errors.Is(err, ErrLockHeld) {
+			// Not holding the lease is the expected, common case on every
+			// non-leader node; back off by roughly the lease TTL rather
+			// than synthesizing a near-future "expiry" and routing it
+			// through ou.next(), which would come back deeply negative
+			// and spin.
+			next = lockRetryDelay(ocspLockTTL)
+		} else {
+			// The locker backend itself is unhealthy: log it and drive
+			// the backoff off failCount like any other failure, rather
+			// than silently behaving like a healthy single-node node.
+			ou.failCount++
+			next = ou.m.RetryBackoff.next(ou.failCount, defaultOCSPBackoffCap)
+			ou.m.logf("autocert: acquiring OCSP refresh lock for %s failed: %v", ou.ck.domain, err)
+		}
+		ou.timer = time.AfterFunc(next, ou.update)
+		testOCSPDidUpdateLoop(next, err)
+		return
+	}
+	defer locker.Release(ctx, "ocsp:"+ou.ck.cacheKey(), token)
+
 	var next time.Duration
 	// state will not be nil
-	state, _ := ou.m.ocspStates[ou.domain]
+	state, _ := ou.m.ocspStates[ou.ck]
 	der, response, err := ou.m.updateOCSPStapling(ctx, state.leaf, state.issuer)
 	if err != nil {
-		// failed
-		next = renewJitter / 2
-		next += time.Duration(pseudoRand.int63n(int64(next)))
+		// failed; a 5xx or tryLater from the responder lands here too
+		ou.failCount++
+		next = ou.m.RetryBackoff.next(ou.failCount, defaultOCSPBackoffCap)
 	} else {
 		// success
+		ou.failCount = 0
 		state.Lock()
 		defer state.Unlock()
 		state.ocspDER = der
+		state.thisUpdate = response.ThisUpdate
 		state.nextUpdate = response.NextUpdate
-		next = ou.next(response.NextUpdate)
+		next = ou.next(response.ThisUpdate, response.NextUpdate)
 	}
 	ou.timer = time.AfterFunc(next, ou.update)
 	testOCSPDidUpdateLoop(next, err)
 }
 
-func (ou *ocspUpdater) next(expiry time.Time) time.Duration {
-	d := expiry.Sub(timeNow()) - 48*time.Hour
+// next computes the delay until the OCSP response should be refreshed.
+// Per the refresh point RFC 5019 recommends, that's the midpoint between
+// ThisUpdate and NextUpdate; we only fall back to a fixed window before
+// expiry when the responder didn't give us a ThisUpdate (e.g. because
+// this is the very first fetch and there's no cached response yet).
+func (ou *ocspUpdater) next(thisUpdate, nextUpdate time.Time) time.Duration {
+	var d time.Duration
+	if thisUpdate.IsZero() {
+		d = nextUpdate.Sub(timeNow()) - 48*time.Hour
+	} else {
+		refreshAt := thisUpdate.Add(nextUpdate.Sub(thisUpdate) / 2)
+		d = refreshAt.Sub(timeNow())
+	}
 	// add a bit randomness to renew deadline
 	n := pseudoRand.int63n(int64(renewJitter))
 	d -= time.Duration(n)
@@ -0,0 +1,29 @@
+package autocert
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestNewSignerLikeMatchesAlgorithm(t *testing.T) {
+	ecKey, err := newSignerLike(certKey{domain: "example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ecKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("newSignerLike(ECDSA certKey) = %T, want *ecdsa.PrivateKey", ecKey)
+	}
+
+	rsaKey, err := newSignerLike(certKey{domain: "example.com", isRSA: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := rsaKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("newSignerLike(RSA certKey) = %T, want *rsa.PrivateKey", rsaKey)
+	}
+	if bits := key.Size() * 8; bits != 2048 {
+		t.Errorf("newSignerLike(RSA certKey) size = %d bits, want 2048", bits)
+	}
+}
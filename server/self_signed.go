@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -12,18 +13,66 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
-	selfSignedMu   sync.Mutex
-	selfSignedCert atomic.Value // *tls.Certificate
+	// selfSignedCerts caches the per-domain leaf certificate issued for
+	// each SNI seen so far. Keys are domain names, values are
+	// *selfSignedEntry. Bounded by maxSelfSignedDomains: once the cache
+	// grows past that, the least-recently-used entries are evicted so an
+	// attacker sending arbitrary SNIs (when CheckSNI is off) can't grow
+	// this cache and its renewal timers without bound.
+	selfSignedCerts sync.Map
+	selfSignedCount int64 // atomic: number of entries currently in selfSignedCerts
+
+	// selfSignedGroup dedupes concurrent create-on-miss calls for the
+	// same domain without serializing unrelated domains behind each
+	// other's Cache round trip, the way a single package-level mutex
+	// would on a burst of distinct SNIs.
+	selfSignedGroup singleflight.Group
+
+	// selfSignedCAMu and selfSignedCA guard the single shared CA used
+	// when Cfg.SelfSigned.CAMode is enabled.
+	selfSignedCAMu sync.Mutex
+	selfSignedCA   *selfSignedCAState
+
+	// selfSignedRenewals tracks the renewal timer for each domain so
+	// GetSelfSignedCertificate doesn't start more than one per domain.
+	selfSignedRenewals sync.Map // domain string -> *selfSignedRenewal
 )
 
+// selfSignedEntry is the value stored in selfSignedCerts.
+type selfSignedEntry struct {
+	cert     *tls.Certificate
+	lastUsed int64 // unix nano, accessed atomically
+}
+
+// defaultMaxSelfSignedDomains bounds selfSignedCerts when
+// Cfg.SelfSigned.MaxCachedDomains isn't set.
+const defaultMaxSelfSignedDomains = 10000
+
+func maxSelfSignedDomains() int64 {
+	if n := Cfg.SelfSigned.MaxCachedDomains; n > 0 {
+		return int64(n)
+	}
+	return defaultMaxSelfSignedDomains
+}
+
+// selfSignedCAState holds the parsed CA certificate and key used to sign
+// per-domain leaf certificates in CA mode.
+type selfSignedCAState struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
 func IsSelfSignedAllowed(domain string) bool {
 	if !Cfg.SelfSigned.Enable {
 		return false
@@ -36,46 +85,112 @@ func IsSelfSignedAllowed(domain string) bool {
 	return true
 }
 
+// selfSignedCacheKey returns the Cache key used to persist domain's
+// self-signed leaf certificate and key.
+func selfSignedCacheKey(domain string) string {
+	return "selfsigned/" + domain
+}
+
+// GetSelfSignedCertificate returns a certificate for domain, generating
+// and caching one (signed by the shared CA when Cfg.SelfSigned.CAMode is
+// set) on first use.
 func GetSelfSignedCertificate(domain string) (*tls.Certificate, error) {
-	if tlscert, ok := selfSignedCert.Load().(*tls.Certificate); ok {
-		return tlscert, nil
+	if v, ok := selfSignedCerts.Load(domain); ok {
+		entry := v.(*selfSignedEntry)
+		atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+		return entry.cert, nil
 	}
 
-	selfSignedMu.Lock()
-	defer selfSignedMu.Unlock()
-	if tlscert, ok := selfSignedCert.Load().(*tls.Certificate); ok {
+	v, err, _ := selfSignedGroup.Do(domain, func() (interface{}, error) {
+		if v, ok := selfSignedCerts.Load(domain); ok {
+			entry := v.(*selfSignedEntry)
+			atomic.StoreInt64(&entry.lastUsed, time.Now().UnixNano())
+			return entry.cert, nil
+		}
+
+		// check storage first
+		tlscert, err := loadCertificateFromStore(selfSignedCacheKey(domain))
+		if err != nil && err != autocert.ErrCacheMiss {
+			return nil, fmt.Errorf("self_signed: %v", err)
+		}
+		if tlscert == nil {
+			// cache not available, create new certificate
+			tlscert, err = createAndSaveSelfSignedCertificate(domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+		storeSelfSignedCert(domain, tlscert)
+		startSelfSignedRenewal(domain)
 		return tlscert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+// storeSelfSignedCert caches tlscert for domain, evicting the
+// least-recently-used entries if that pushes the cache past
+// maxSelfSignedDomains.
+func storeSelfSignedCert(domain string, tlscert *tls.Certificate) {
+	_, existed := selfSignedCerts.Load(domain)
+	selfSignedCerts.Store(domain, &selfSignedEntry{cert: tlscert, lastUsed: time.Now().UnixNano()})
+	if !existed && atomic.AddInt64(&selfSignedCount, 1) > maxSelfSignedDomains() {
+		evictLRUSelfSigned()
 	}
+}
 
-	// check storage first
-	tlscert, err := loadCertificateFromStore(domain)
-	if err != nil && err != autocert.ErrCacheMiss {
-		return nil, fmt.Errorf("self_signed: %v", err)
+// evictLRUSelfSigned trims selfSignedCerts down to maxSelfSignedDomains,
+// dropping the entries that were used longest ago and stopping their
+// renewal timers.
+func evictLRUSelfSigned() {
+	type candidate struct {
+		domain   string
+		lastUsed int64
 	}
-	if tlscert != nil {
-		selfSignedCert.Store(tlscert)
-		return tlscert, nil
+	var candidates []candidate
+	selfSignedCerts.Range(func(k, v interface{}) bool {
+		candidates = append(candidates, candidate{k.(string), atomic.LoadInt64(&v.(*selfSignedEntry).lastUsed)})
+		return true
+	})
+	limit := maxSelfSignedDomains()
+	if int64(len(candidates)) <= limit {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed < candidates[j].lastUsed })
+	for _, c := range candidates[:int64(len(candidates))-limit] {
+		evictSelfSigned(c.domain)
 	}
+}
 
-	// cache not available, create new certificate
-	tlscert, err = createAndSaveSelfSignedCertificate()
-	if err != nil {
-		return nil, err
+// evictSelfSigned drops domain's cached cert and stops its renewal timer.
+func evictSelfSigned(domain string) {
+	if v, ok := selfSignedRenewals.LoadAndDelete(domain); ok {
+		v.(*selfSignedRenewal).stop()
+	}
+	if _, ok := selfSignedCerts.LoadAndDelete(domain); ok {
+		atomic.AddInt64(&selfSignedCount, -1)
 	}
-	selfSignedCert.Store(tlscert)
-	return tlscert, nil
 }
 
-func createAndSaveSelfSignedCertificate() (*tls.Certificate, error) {
+func createAndSaveSelfSignedCertificate(domain string) (*tls.Certificate, error) {
 	validDays := Cfg.SelfSigned.ValidDays
 	organization := Cfg.SelfSigned.Organization
-	certPEM, privKeyPEM, err := CreateSelfSignedCertificate(validDays, organization)
+
+	var certPEM, privKeyPEM []byte
+	var err error
+	if Cfg.SelfSigned.CAMode {
+		certPEM, privKeyPEM, err = CreateCASignedCertificate(domain, validDays, organization)
+	} else {
+		certPEM, privKeyPEM, err = CreateSelfSignedCertificate(domain, validDays, organization)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	cacheData := append(privKeyPEM, certPEM...)
-	err = Cfg.Storage.Cache.Put(context.Background(), Cfg.SelfSigned.CertKey, cacheData)
+	err = Cfg.Storage.Cache.Put(context.Background(), selfSignedCacheKey(domain), cacheData)
 	if err != nil {
 		return nil, fmt.Errorf("self_signed: failed put certificate: %v", err)
 	}
@@ -83,16 +198,18 @@ func createAndSaveSelfSignedCertificate() (*tls.Certificate, error) {
 	return tlscert, nil
 }
 
-func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM, privKeyPEM []byte, err error) {
+// CreateSelfSignedCertificate creates a leaf certificate for domain that
+// is its own issuer. The certificate carries domain as a DNS SAN (or an
+// IP SAN if domain parses as an IP address) so that it validates against
+// the SNI it was requested for.
+func CreateSelfSignedCertificate(domain string, validDays int, organization []string) (certPEM, privKeyPEM []byte, err error) {
 	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		err = fmt.Errorf("self_singed: failed generate private key: %v", err)
+		err = fmt.Errorf("self_signed: failed generate private key: %v", err)
 		return
 	}
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := newSerialNumber()
 	if err != nil {
-		err = fmt.Errorf("self_signed: failed generate serial number: %v", err)
 		return
 	}
 
@@ -102,6 +219,7 @@ func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM,
 	certificate := &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
+			CommonName:   domain,
 			Organization: organization,
 		},
 		NotBefore: now,
@@ -111,6 +229,8 @@ func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
+	setCertificateSAN(certificate, domain)
+
 	certBytes, err := x509.CreateCertificate(rand.Reader, certificate, certificate, &privKey.PublicKey, privKey)
 	if err != nil {
 		err = fmt.Errorf("self_signed: failed create certificate: %v", err)
@@ -126,3 +246,267 @@ func CreateSelfSignedCertificate(validDays int, organization []string) (certPEM,
 	privKeyPEM = privKeyBuf.Bytes()
 	return
 }
+
+// CreateCASignedCertificate creates a leaf certificate for domain signed
+// by the shared self-signed CA (generating the CA on first use), so that
+// operators can import one CA into their trust stores instead of every
+// per-domain leaf.
+func CreateCASignedCertificate(domain string, validDays int, organization []string) (certPEM, privKeyPEM []byte, err error) {
+	ca, err := getOrCreateSelfSignedCA(organization)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("self_signed: failed generate private key: %v", err)
+		return
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+
+	var now = time.Now()
+	var validDuration = time.Duration(validDays) * 24 * time.Hour
+
+	certificate := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   domain,
+			Organization: organization,
+		},
+		NotBefore:   now,
+		NotAfter:    now.Add(validDuration),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	setCertificateSAN(certificate, domain)
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, certificate, ca.cert, &privKey.PublicKey, ca.key)
+	if err != nil {
+		err = fmt.Errorf("self_signed: failed create certificate: %v", err)
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
+	privKeyBuf := &bytes.Buffer{}
+	_ = EncodeECDSAKey(privKeyBuf, privKey)
+	privKeyPEM = privKeyBuf.Bytes()
+	return
+}
+
+// defaultSelfSignedCACacheKey is used when Cfg.SelfSigned.CACacheKey is unset.
+const defaultSelfSignedCACacheKey = "selfsigned/ca"
+
+// selfSignedCACacheKey returns the Cache key the shared CA certificate
+// and key are persisted under, defaulting to defaultSelfSignedCACacheKey
+// when Cfg.SelfSigned.CACacheKey isn't configured.
+func selfSignedCACacheKey() string {
+	if Cfg.SelfSigned.CACacheKey != "" {
+		return Cfg.SelfSigned.CACacheKey
+	}
+	return defaultSelfSignedCACacheKey
+}
+
+// selfSignedCAValidDays is how long the generated CA is valid for.
+// It's intentionally long-lived since operators import it once into
+// their trust stores and rotating it would invalidate that trust.
+const selfSignedCAValidDays = 10 * 365
+
+func getOrCreateSelfSignedCA(organization []string) (*selfSignedCAState, error) {
+	selfSignedCAMu.Lock()
+	defer selfSignedCAMu.Unlock()
+	if selfSignedCA != nil {
+		return selfSignedCA, nil
+	}
+
+	data, err := Cfg.Storage.Cache.Get(context.Background(), selfSignedCACacheKey())
+	if err != nil && err != autocert.ErrCacheMiss {
+		return nil, fmt.Errorf("self_signed: failed get CA: %v", err)
+	}
+	if err == nil {
+		state, perr := parseSelfSignedCA(data)
+		if perr != nil {
+			return nil, fmt.Errorf("self_signed: failed parse cached CA: %v", perr)
+		}
+		selfSignedCA = state
+		return selfSignedCA, nil
+	}
+
+	certPEM, privKeyPEM, err := createSelfSignedCACert(organization)
+	if err != nil {
+		return nil, err
+	}
+	cacheData := append(privKeyPEM, certPEM...)
+	if err = Cfg.Storage.Cache.Put(context.Background(), selfSignedCACacheKey(), cacheData); err != nil {
+		return nil, fmt.Errorf("self_signed: failed put CA: %v", err)
+	}
+	state, err := parseSelfSignedCA(cacheData)
+	if err != nil {
+		return nil, fmt.Errorf("self_signed: failed parse generated CA: %v", err)
+	}
+	selfSignedCA = state
+	return selfSignedCA, nil
+}
+
+func createSelfSignedCACert(organization []string) (certPEM, privKeyPEM []byte, err error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("self_signed: failed generate CA private key: %v", err)
+		return
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	certificate := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   "ssl-cert-server self-signed CA",
+			Organization: organization,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Duration(selfSignedCAValidDays) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, certificate, certificate, &privKey.PublicKey, privKey)
+	if err != nil {
+		err = fmt.Errorf("self_signed: failed create CA certificate: %v", err)
+		return
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})
+	privKeyBuf := &bytes.Buffer{}
+	_ = EncodeECDSAKey(privKeyBuf, privKey)
+	privKeyPEM = privKeyBuf.Bytes()
+	return
+}
+
+func parseSelfSignedCA(data []byte) (*selfSignedCAState, error) {
+	tlscert, err := parseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := tlscert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA private key does not implement crypto.Signer")
+	}
+	return &selfSignedCAState{cert: tlscert.Leaf, key: key}, nil
+}
+
+// setCertificateSAN adds domain to cert as a DNS SAN, or as an IP SAN if
+// domain parses as an IP address.
+func setCertificateSAN(cert *x509.Certificate, domain string) {
+	if ip := net.ParseIP(domain); ip != nil {
+		cert.IPAddresses = []net.IP{ip}
+		return
+	}
+	cert.DNSNames = []string{domain}
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("self_signed: failed generate serial number: %v", err)
+	}
+	return serialNumber, nil
+}
+
+// selfSignedRenewBefore controls how long before NotAfter a self-signed
+// leaf is regenerated.
+const selfSignedRenewBefore = 24 * time.Hour
+
+// selfSignedRenewal mirrors autocert's domainRenewal: a timer that
+// regenerates a single domain's self-signed leaf before it expires.
+type selfSignedRenewal struct {
+	domain string
+
+	timerMu sync.Mutex
+	timer   *time.Timer
+	stopped bool // set by stop(), checked so an in-flight renew() can't resurrect the timer
+}
+
+func startSelfSignedRenewal(domain string) {
+	if _, loaded := selfSignedRenewals.LoadOrStore(domain, &selfSignedRenewal{domain: domain}); loaded {
+		return
+	}
+	sr, _ := selfSignedRenewals.Load(domain)
+	sr.(*selfSignedRenewal).scheduleNext()
+}
+
+// stop cancels sr's renewal timer. Called when evictLRUSelfSigned drops a
+// domain so its renewal goroutine doesn't keep running for a cert no
+// longer in selfSignedCerts.
+func (sr *selfSignedRenewal) stop() {
+	sr.timerMu.Lock()
+	defer sr.timerMu.Unlock()
+	sr.stopped = true
+	if sr.timer != nil {
+		sr.timer.Stop()
+		sr.timer = nil
+	}
+}
+
+func (sr *selfSignedRenewal) scheduleNext() {
+	v, ok := selfSignedCerts.Load(sr.domain)
+	if !ok {
+		return
+	}
+	tlscert := v.(*selfSignedEntry).cert
+	next := time.Until(tlscert.Leaf.NotAfter) - selfSignedRenewBefore
+	if next < 0 {
+		next = 0
+	}
+	sr.timerMu.Lock()
+	defer sr.timerMu.Unlock()
+	if sr.stopped {
+		return
+	}
+	sr.timer = time.AfterFunc(next, sr.renew)
+}
+
+func (sr *selfSignedRenewal) renew() {
+	sr.timerMu.Lock()
+	stopped := sr.stopped
+	sr.timerMu.Unlock()
+	if stopped {
+		return
+	}
+
+	tlscert, err := createAndSaveSelfSignedCertificate(sr.domain)
+	if err != nil {
+		// try again later rather than serving a stale cert forever
+		sr.timerMu.Lock()
+		if !sr.stopped {
+			sr.timer = time.AfterFunc(time.Hour, sr.renew)
+		}
+		sr.timerMu.Unlock()
+		return
+	}
+
+	sr.timerMu.Lock()
+	stopped = sr.stopped
+	sr.timerMu.Unlock()
+	if stopped {
+		// evictLRUSelfSigned dropped this domain while the cert above was
+		// being generated; storing it now would resurrect an evicted
+		// entry with a fresh lastUsed (defeating the LRU eviction that
+		// just ran) with no renewal timer left to keep it current.
+		return
+	}
+	storeSelfSignedCert(sr.domain, tlscert)
+	sr.scheduleNext()
+}
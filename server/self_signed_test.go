@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func parseCertPEM(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCreateSelfSignedCertificateDNSSAN(t *testing.T) {
+	certPEM, _, err := CreateSelfSignedCertificate("example.com", 90, []string{"Acme Co"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCertPEM(t, certPEM)
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "example.com" {
+		t.Errorf("DNSNames = %v, want [example.com]", cert.DNSNames)
+	}
+	if len(cert.IPAddresses) != 0 {
+		t.Errorf("IPAddresses = %v, want none", cert.IPAddresses)
+	}
+	if cert.Subject.CommonName != "example.com" {
+		t.Errorf("CommonName = %q, want %q", cert.Subject.CommonName, "example.com")
+	}
+}
+
+func TestCreateSelfSignedCertificateIPSAN(t *testing.T) {
+	certPEM, _, err := CreateSelfSignedCertificate("127.0.0.1", 90, []string{"Acme Co"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCertPEM(t, certPEM)
+	if len(cert.DNSNames) != 0 {
+		t.Errorf("DNSNames = %v, want none", cert.DNSNames)
+	}
+	if len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "127.0.0.1" {
+		t.Errorf("IPAddresses = %v, want [127.0.0.1]", cert.IPAddresses)
+	}
+}
+
+// resetSelfSignedCache clears selfSignedCerts/selfSignedRenewals/selfSignedCount
+// so tests don't see entries left behind by each other.
+func resetSelfSignedCache(t *testing.T) {
+	t.Helper()
+	selfSignedCerts.Range(func(k, _ interface{}) bool {
+		selfSignedCerts.Delete(k)
+		return true
+	})
+	selfSignedRenewals.Range(func(k, _ interface{}) bool {
+		selfSignedRenewals.Delete(k)
+		return true
+	})
+	atomic.StoreInt64(&selfSignedCount, 0)
+}
+
+func TestStoreSelfSignedCertEvictsLRU(t *testing.T) {
+	resetSelfSignedCache(t)
+	t.Cleanup(func() { resetSelfSignedCache(t) })
+
+	orig := Cfg.SelfSigned.MaxCachedDomains
+	Cfg.SelfSigned.MaxCachedDomains = 3
+	t.Cleanup(func() { Cfg.SelfSigned.MaxCachedDomains = orig })
+
+	domains := []string{"d0.example.com", "d1.example.com", "d2.example.com", "d3.example.com", "d4.example.com"}
+	for _, d := range domains {
+		storeSelfSignedCert(d, &tls.Certificate{})
+		// storeSelfSignedCert orders eviction by lastUsed, which it stamps
+		// with time.Now(); space out the stores so ties can't make
+		// eviction order flaky on low-resolution clocks.
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := atomic.LoadInt64(&selfSignedCount); got != 3 {
+		t.Fatalf("selfSignedCount = %d, want 3", got)
+	}
+	for _, d := range domains[:2] {
+		if _, ok := selfSignedCerts.Load(d); ok {
+			t.Errorf("domain %s should have been evicted", d)
+		}
+	}
+	for _, d := range domains[2:] {
+		if _, ok := selfSignedCerts.Load(d); !ok {
+			t.Errorf("domain %s should still be cached", d)
+		}
+	}
+}
+
+// memCache is a minimal in-memory autocert.Cache used to exercise the
+// CA persistence path without touching real storage.
+type memCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (c *memCache) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (c *memCache) Put(_ context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		c.data = make(map[string][]byte)
+	}
+	c.data[key] = data
+	return nil
+}
+
+func (c *memCache) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+	return nil
+}
+
+func TestCreateCASignedCertificateVerifiesAgainstCA(t *testing.T) {
+	origCache := Cfg.Storage.Cache
+	origCA := selfSignedCA
+	Cfg.Storage.Cache = &memCache{}
+	selfSignedCA = nil
+	t.Cleanup(func() {
+		Cfg.Storage.Cache = origCache
+		selfSignedCA = origCA
+	})
+
+	certPEM, _, err := CreateCASignedCertificate("example.com", 90, []string{"Acme Co"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := parseCertPEM(t, certPEM)
+	if selfSignedCA == nil {
+		t.Fatal("getOrCreateSelfSignedCA did not populate selfSignedCA")
+	}
+	if err := leaf.CheckSignatureFrom(selfSignedCA.cert); err != nil {
+		t.Errorf("leaf is not signed by the generated CA: %v", err)
+	}
+}